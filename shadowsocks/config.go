@@ -0,0 +1,455 @@
+// Copyright 2021 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// ProxyConfig contains the parameters to connect to a Shadowsocks proxy, as defined by the SIP008
+// online configuration format: https://shadowsocks.org/guide/sip008.html.
+type ProxyConfig struct {
+	Host       string `json:"server"`
+	Port       int    `json:"server_port"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+	Tag        string `json:"tag,omitempty"`
+	Plugin     string `json:"plugin,omitempty"`
+	PluginOpts string `json:"plugin_opts,omitempty"`
+}
+
+// sip008Response is the JSON document served by a SIP008-compliant online configuration server.
+type sip008Response struct {
+	Proxies []ProxyConfig `json:"servers"`
+	Version int           `json:"version"`
+}
+
+// FetchConfigRequest specifies how to retrieve and validate a SIP008 online configuration.
+type FetchConfigRequest struct {
+	// URL is the HTTPS endpoint that serves the SIP008 configuration document.
+	URL string
+	// Method is the HTTP method to use for the request (e.g. "GET").
+	Method string
+	// CertFingerprint pins the TLS connection to a set of known certificates. It holds one or
+	// more pins separated by commas or newlines; each pin is either the base64-encoded SHA-256
+	// hash of a full leaf certificate (as produced by computeCertificateFingerprint) or an
+	// RFC 7469 SPKI pin of the form "sha256/<base64>" covering only the certificate's
+	// SubjectPublicKeyInfo. The connection succeeds if the server's leaf certificate matches any
+	// pin in the set, which lets operators publish the next certificate's pin ahead of a
+	// rotation. When empty, the system trust store is used instead.
+	CertFingerprint string
+	// RevocationMode controls how certificate revocation is enforced via OCSP. It defaults to
+	// RevocationSoftFail when empty.
+	RevocationMode RevocationMode
+	// ClientCertPEM and ClientKeyPEM are a PEM-encoded client certificate and private key to
+	// present for mutual TLS. Both must be set together; they are ignored if ClientPKCS12 is set.
+	ClientCertPEM string
+	ClientKeyPEM  string
+	// ClientPKCS12 is a base64-encoded PKCS#12 (PFX) archive holding a client certificate and
+	// private key, used in place of ClientCertPEM/ClientKeyPEM. ClientPKCS12Password decrypts it.
+	ClientPKCS12         string
+	ClientPKCS12Password string
+	// RootCAsPEM, when set, replaces the system trust store with a custom PEM-encoded CA bundle
+	// for validating the server's certificate. It composes with CertFingerprint for a layered
+	// trust model: the pin authenticates the leaf while RootCAsPEM establishes the chain of
+	// trust for any verification CertFingerprint doesn't perform itself.
+	RootCAsPEM string
+	// ViaProxy, when set, tunnels the fetch through an existing Shadowsocks proxy instead of
+	// dialing req.URL's host directly, for bootstrapping a configuration update over a
+	// previously-working proxy on a network where the URL itself is blocked. All other request
+	// fields, including CertFingerprint pinning, still apply end-to-end to the tunneled
+	// connection. ViaProxy.Method must be one of the AEAD ciphers in ssCiphers.
+	ViaProxy *ProxyConfig
+}
+
+// RevocationMode controls how FetchConfig reacts to OCSP revocation checking outcomes.
+type RevocationMode string
+
+const (
+	// RevocationOff disables OCSP revocation checking entirely.
+	RevocationOff RevocationMode = "off"
+	// RevocationSoftFail treats network errors, malformed responses, and an unknown status as
+	// allowed, only rejecting a certificate the responder explicitly reports as revoked. This is
+	// the default.
+	RevocationSoftFail RevocationMode = "soft-fail"
+	// RevocationHardFail rejects the connection unless the responder affirmatively reports the
+	// certificate as good; network errors, malformed responses, and an unknown status all block.
+	RevocationHardFail RevocationMode = "hard-fail"
+)
+
+// normalize returns the effective mode, defaulting an empty value to RevocationSoftFail.
+func (m RevocationMode) normalize() RevocationMode {
+	if m == "" {
+		return RevocationSoftFail
+	}
+	return m
+}
+
+// FetchConfigResponse carries the outcome of a FetchConfig call.
+type FetchConfigResponse struct {
+	HTTPStatusCode int
+	RedirectURL    string
+	Proxies        []ProxyConfig
+}
+
+// newFetchConfigClient builds the http.Client used to fetch req's URL, wiring up certificate
+// pinning, revocation checking, mutual TLS, and custom root CAs as configured on req. It is
+// shared by FetchConfig and ConfigPoller so both apply the same connection security policy.
+func newFetchConfigClient(req FetchConfigRequest) (*http.Client, error) {
+	if !strings.HasPrefix(strings.ToLower(req.URL), "https://") {
+		return nil, errors.New("online configuration URL must use HTTPS")
+	}
+	dial := (&net.Dialer{}).DialContext
+	if req.ViaProxy != nil {
+		proxy := req.ViaProxy
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialShadowsocks(ctx, proxy, addr)
+		}
+	}
+
+	tlsConfig := &tls.Config{}
+	if req.RootCAsPEM != "" {
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM([]byte(req.RootCAsPEM)) {
+			return nil, errors.New("failed to parse custom root CA bundle")
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if pins := splitFingerprintPins(req.CertFingerprint); len(pins) > 0 {
+		// VerifyPeerCertificate replaces the default chain validation entirely, so we disable it
+		// here and pin against the configured fingerprints instead. tlsConfig.RootCAs, if set, is
+		// threaded through so a pinned connection is also chain-validated against it.
+		tlsConfig.InsecureSkipVerify = true
+		rootCAs := tlsConfig.RootCAs
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyCertificatePins(rawCerts, pins, rootCAs)
+		}
+	}
+	clientCert, err := loadClientCertificate(req)
+	if err != nil {
+		return nil, err
+	}
+	if clientCert != nil {
+		tlsConfig.Certificates = append(tlsConfig.Certificates, *clientCert)
+	}
+
+	transport := &http.Transport{TLSClientConfig: tlsConfig, DialContext: dial}
+	if mode := req.RevocationMode.normalize(); mode != RevocationOff {
+		// ocspClient issues the direct OCSP-responder lookup in checkRevocation over the same
+		// dial (and so the same ViaProxy tunnel, if any) as the connection it's checking, rather
+		// than reaching the responder directly.
+		ocspClient := &http.Client{Transport: &http.Transport{DialContext: dial}}
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			rawConn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			// DialTLSContext bypasses the Transport's own TLS setup, so the server name used
+			// for chain and hostname verification has to be taken from addr here.
+			connConfig := tlsConfig.Clone()
+			if connConfig.ServerName == "" {
+				connConfig.ServerName, _, _ = net.SplitHostPort(addr)
+			}
+			tlsConn := tls.Client(rawConn, connConfig)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				rawConn.Close()
+				return nil, err
+			}
+			if err := checkRevocation(tlsConn.ConnectionState(), mode, ocspClient); err != nil {
+				tlsConn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}, nil
+}
+
+// FetchConfig retrieves a SIP008 online configuration document per req, optionally pinning the
+// TLS connection to one or more known certificate fingerprints and checking the server
+// certificate's revocation status via OCSP.
+func FetchConfig(req FetchConfigRequest) (*FetchConfigResponse, error) {
+	client, err := newFetchConfigClient(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(req.Method, req.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	httpRes, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch online configuration: %w", err)
+	}
+	defer httpRes.Body.Close()
+
+	res := &FetchConfigResponse{HTTPStatusCode: httpRes.StatusCode}
+	if httpRes.StatusCode == http.StatusMovedPermanently || httpRes.StatusCode == http.StatusFound {
+		res.RedirectURL = httpRes.Header.Get("Location")
+		return res, nil
+	}
+	if httpRes.StatusCode != http.StatusOK {
+		return res, nil
+	}
+
+	body, err := ioutil.ReadAll(httpRes.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read online configuration response: %w", err)
+	}
+	var sip008 sip008Response
+	if err := json.Unmarshal(body, &sip008); err != nil {
+		return nil, fmt.Errorf("failed to parse online configuration: %w", err)
+	}
+	res.Proxies = sip008.Proxies
+	return res, nil
+}
+
+// splitFingerprintPins splits a CertFingerprint value into its individual pins, trimming
+// whitespace and discarding empty entries.
+func splitFingerprintPins(s string) []string {
+	var pins []string
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		if pin := strings.TrimSpace(line); pin != "" {
+			pins = append(pins, pin)
+		}
+	}
+	return pins
+}
+
+// verifyCertificatePins checks the server's leaf certificate, given as rawCerts[0], against
+// pins. A pin matches if it equals either the full-certificate fingerprint or the SPKI
+// fingerprint of the leaf. When rootCAs is non-nil, a matching leaf must additionally chain to
+// one of those CAs, layering RootCAsPEM's chain-of-trust check on top of the pin; when rootCAs is
+// nil, the pin alone is trusted, which is what lets this pin a self-signed certificate.
+func verifyCertificatePins(rawCerts [][]byte, pins []string, rootCAs *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no certificate presented by server")
+	}
+	leafDER := rawCerts[0]
+	certFingerprint := computeCertificateFingerprint(leafDER)
+	spkiFingerprint, err := computeSPKIFingerprint(leafDER)
+	if err != nil {
+		return err
+	}
+	matched := false
+	for _, pin := range pins {
+		if pin == certFingerprint || pin == spkiFingerprint {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return errors.New("certificate does not match any pinned fingerprint")
+	}
+	if rootCAs == nil {
+		return nil
+	}
+
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		return fmt.Errorf("failed to parse pinned certificate: %w", err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range rawCerts[1:] {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("failed to parse intermediate certificate: %w", err)
+		}
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: rootCAs, Intermediates: intermediates}); err != nil {
+		return fmt.Errorf("pinned certificate failed chain validation against RootCAsPEM: %w", err)
+	}
+	return nil
+}
+
+// loadClientCertificate builds the client certificate to present for mutual TLS from the PEM or
+// PKCS#12 material in req, preferring PKCS#12 when both are set. It returns a nil certificate,
+// with no error, when neither is configured.
+func loadClientCertificate(req FetchConfigRequest) (*tls.Certificate, error) {
+	if req.ClientPKCS12 != "" {
+		der, err := base64.StdEncoding.DecodeString(req.ClientPKCS12)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode PKCS#12 client certificate: %w", err)
+		}
+		key, cert, err := pkcs12.Decode(der, req.ClientPKCS12Password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PKCS#12 client certificate: %w", err)
+		}
+		return &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}, nil
+	}
+	if req.ClientCertPEM != "" || req.ClientKeyPEM != "" {
+		cert, err := tls.X509KeyPair([]byte(req.ClientCertPEM), []byte(req.ClientKeyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		return &cert, nil
+	}
+	return nil, nil
+}
+
+// computeCertificateFingerprint returns the base64-encoded SHA-256 hash of a DER-encoded
+// certificate, used to pin TLS connections against a known full certificate.
+func computeCertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// computeSPKIFingerprint returns the RFC 7469 SPKI pin, in the form "sha256/<base64>", of a
+// DER-encoded certificate's SubjectPublicKeyInfo. Unlike computeCertificateFingerprint, this
+// fingerprint survives a certificate renewal that reuses the same key pair.
+func computeSPKIFingerprint(der []byte) (string, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// ocspCache holds recently fetched OCSP responses, keyed by a hash of the certificate's serial
+// number and issuer, so that repeated fetches against the same server don't each pay for an OCSP
+// round-trip. An entry whose response's NextUpdate has passed is ignored and replaced by the next
+// successful lookup; entries are never removed.
+var (
+	ocspCacheMu sync.Mutex
+	ocspCache   = make(map[string]*ocsp.Response)
+)
+
+// ocspCacheKey identifies a (leaf, issuer) pair for the purposes of the OCSP cache.
+func ocspCacheKey(leaf, issuer *x509.Certificate) string {
+	issuerHash := sha256.Sum256(issuer.Raw)
+	return fmt.Sprintf("%s:%x", leaf.SerialNumber.String(), issuerHash)
+}
+
+// checkRevocation enforces mode against the certificate chain presented in state. It first
+// honors a stapled OCSP response, falling back to directly querying the leaf certificate's OCSP
+// responder over httpClient, so that lookup honors the same ViaProxy tunnel (if any) as the
+// connection being checked.
+func checkRevocation(state tls.ConnectionState, mode RevocationMode, httpClient *http.Client) error {
+	if mode == RevocationOff || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	leaf := state.PeerCertificates[0]
+	var issuer *x509.Certificate
+	if len(state.PeerCertificates) > 1 {
+		issuer = state.PeerCertificates[1]
+	}
+
+	if len(state.OCSPResponse) > 0 && issuer != nil {
+		resp, err := ocsp.ParseResponse(state.OCSPResponse, issuer)
+		if err == nil {
+			return evaluateOCSPStatus(resp, mode)
+		}
+		if mode == RevocationHardFail {
+			return fmt.Errorf("failed to parse stapled OCSP response: %w", err)
+		}
+		// Soft-fail: an unusable staple is treated the same as a missing one, so fall through to
+		// a direct OCSP lookup.
+	}
+
+	resp, err := fetchOCSPResponse(leaf, issuer, httpClient)
+	if err != nil {
+		if mode == RevocationHardFail {
+			return fmt.Errorf("failed to determine certificate revocation status: %w", err)
+		}
+		return nil
+	}
+	return evaluateOCSPStatus(resp, mode)
+}
+
+// evaluateOCSPStatus applies mode's policy to an OCSP response that was successfully obtained
+// and parsed.
+func evaluateOCSPStatus(resp *ocsp.Response, mode RevocationMode) error {
+	switch resp.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return errors.New("certificate has been revoked")
+	default:
+		if mode == RevocationHardFail {
+			return errors.New("certificate revocation status is unknown")
+		}
+		return nil
+	}
+}
+
+// fetchOCSPResponse queries leaf's OCSP responder directly over httpClient, serving a cached
+// response when one is still within its validity window.
+func fetchOCSPResponse(leaf, issuer *x509.Certificate, httpClient *http.Client) (*ocsp.Response, error) {
+	if issuer == nil {
+		return nil, errors.New("no issuer certificate available for OCSP lookup")
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, errors.New("certificate does not advertise an OCSP responder")
+	}
+
+	key := ocspCacheKey(leaf, issuer)
+	ocspCacheMu.Lock()
+	if resp, ok := ocspCache[key]; ok && time.Now().Before(resp.NextUpdate) {
+		ocspCacheMu.Unlock()
+		return resp, nil
+	}
+	ocspCacheMu.Unlock()
+
+	reqBytes, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCSP request: %w", err)
+	}
+	httpRes, err := httpClient.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(reqBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach OCSP responder: %w", err)
+	}
+	defer httpRes.Body.Close()
+	body, err := ioutil.ReadAll(httpRes.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCSP response: %w", err)
+	}
+	resp, err := ocsp.ParseResponse(body, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OCSP response: %w", err)
+	}
+
+	ocspCacheMu.Lock()
+	ocspCache[key] = resp
+	ocspCacheMu.Unlock()
+	return resp, nil
+}
@@ -0,0 +1,260 @@
+// Copyright 2021 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the SIP008 document delivered to a ConfigPoller's subscriber on each successful
+// refresh.
+type Config struct {
+	Proxies []ProxyConfig
+}
+
+const (
+	// maxConfigPollerRedirects bounds how many 301/302 hops ConfigPoller follows in one refresh,
+	// to avoid chasing a redirect loop forever.
+	maxConfigPollerRedirects = 5
+	// minConfigPollerBackoff and maxConfigPollerBackoff bound the exponential backoff applied
+	// after a failed refresh.
+	minConfigPollerBackoff = 1 * time.Second
+	maxConfigPollerBackoff = 5 * time.Minute
+)
+
+// ConfigPoller periodically refreshes a SIP008 online configuration in the background, honoring
+// the server's HTTP caching headers, and delivers each outcome to a subscriber callback. Create
+// one with NewConfigPoller and release it with Stop once it is no longer needed.
+type ConfigPoller struct {
+	onUpdate func(Config, error)
+	interval time.Duration
+
+	// client is built once, from the request's connection security settings (pinning, mTLS,
+	// revocation, ViaProxy), and reused across every tick so repeated refreshes don't each leak a
+	// kept-alive connection; only req.URL varies tick to tick, following a redirect. clientErr
+	// holds an error building it, surfaced by every refresh in place of a fetch attempt.
+	client    *http.Client
+	clientErr error
+
+	// mu guards the fields below, which carry state from one refresh to the next: req.URL holds
+	// the target of the last followed redirect, and etag/lastModified feed the next conditional
+	// request.
+	mu           sync.Mutex
+	req          FetchConfigRequest
+	etag         string
+	lastModified string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewConfigPoller starts a goroutine that fetches req immediately and then again every interval,
+// adjusted by the server's Cache-Control/Expires headers, until Stop is called. onUpdate is
+// invoked from that goroutine with the fetched Config on success, or a non-nil error on failure;
+// it is not called for a 304 Not Modified response, since the configuration hasn't changed.
+func NewConfigPoller(req FetchConfigRequest, interval time.Duration, onUpdate func(Config, error)) *ConfigPoller {
+	client, err := newFetchConfigClient(req)
+	p := &ConfigPoller{
+		onUpdate:  onUpdate,
+		interval:  interval,
+		client:    client,
+		clientErr: err,
+		req:       req,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Stop ends background polling. It blocks until the poller's goroutine has exited, so onUpdate
+// is guaranteed not to be called again once Stop returns, and releases the poller's idle
+// connections.
+func (p *ConfigPoller) Stop() {
+	close(p.stop)
+	<-p.done
+	if p.client != nil {
+		p.client.CloseIdleConnections()
+	}
+}
+
+func (p *ConfigPoller) run() {
+	defer close(p.done)
+
+	backoff := minConfigPollerBackoff
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-timer.C:
+		}
+
+		wait, err := p.refresh()
+		if err != nil {
+			p.onUpdate(Config{}, err)
+			wait = jitter(backoff)
+			backoff *= 2
+			if backoff > maxConfigPollerBackoff {
+				backoff = maxConfigPollerBackoff
+			}
+		} else {
+			backoff = minConfigPollerBackoff
+		}
+		timer.Reset(wait)
+	}
+}
+
+// refresh performs one SIP008 fetch, following redirects and applying conditional request
+// headers, and returns how long to wait before the next refresh.
+func (p *ConfigPoller) refresh() (time.Duration, error) {
+	if p.clientErr != nil {
+		return p.interval, p.clientErr
+	}
+
+	p.mu.Lock()
+	req := p.req
+	etag := p.etag
+	lastModified := p.lastModified
+	p.mu.Unlock()
+
+	for hop := 0; ; hop++ {
+		if hop > maxConfigPollerRedirects {
+			return p.interval, fmt.Errorf("too many redirects refreshing online configuration")
+		}
+
+		httpRes, err := doConditionalFetch(p.client, req, etag, lastModified)
+		if err != nil {
+			return p.interval, err
+		}
+		config, redirectURL, nextEtag, nextLastModified, wait, err :=
+			p.handleResponse(httpRes)
+		if err != nil {
+			return p.interval, err
+		}
+		if redirectURL != "" {
+			req.URL = redirectURL
+			etag, lastModified = "", ""
+			continue
+		}
+
+		p.mu.Lock()
+		p.req.URL = req.URL
+		p.etag = nextEtag
+		p.lastModified = nextLastModified
+		p.mu.Unlock()
+
+		if config != nil {
+			p.onUpdate(*config, nil)
+		}
+		return wait, nil
+	}
+}
+
+// handleResponse interprets one HTTP response from a refresh attempt. It returns a non-nil
+// config on a 200 with a parseable body, a non-empty redirectURL on a 301/302 to follow, and the
+// ETag/Last-Modified values to remember for the next conditional request.
+func (p *ConfigPoller) handleResponse(httpRes *http.Response) (
+	config *Config, redirectURL, etag, lastModified string, wait time.Duration, err error) {
+	defer httpRes.Body.Close()
+
+	wait = cacheControlInterval(httpRes.Header, p.interval)
+	etag = httpRes.Header.Get("ETag")
+	lastModified = httpRes.Header.Get("Last-Modified")
+
+	switch httpRes.StatusCode {
+	case http.StatusNotModified:
+		return nil, "", etag, lastModified, wait, nil
+	case http.StatusMovedPermanently, http.StatusFound:
+		location := httpRes.Header.Get("Location")
+		if location == "" {
+			return nil, "", "", "", wait, fmt.Errorf("redirect response missing Location header")
+		}
+		return nil, location, "", "", wait, nil
+	case http.StatusOK:
+		body, err := ioutil.ReadAll(httpRes.Body)
+		if err != nil {
+			return nil, "", "", "", wait, fmt.Errorf("failed to read online configuration response: %w", err)
+		}
+		var sip008 sip008Response
+		if err := json.Unmarshal(body, &sip008); err != nil {
+			return nil, "", "", "", wait, fmt.Errorf("failed to parse online configuration: %w", err)
+		}
+		return &Config{Proxies: sip008.Proxies}, "", etag, lastModified, wait, nil
+	default:
+		return nil, "", "", "", wait, fmt.Errorf("unexpected HTTP status %d refreshing online configuration", httpRes.StatusCode)
+	}
+}
+
+// doConditionalFetch issues a single GET against req.URL over client, sending etag and
+// lastModified as If-None-Match/If-Modified-Since when present so an unchanged document comes
+// back as a cheap 304 Not Modified.
+func doConditionalFetch(client *http.Client, req FetchConfigRequest, etag, lastModified string) (*http.Response, error) {
+	httpReq, err := http.NewRequest(req.Method, req.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	if etag != "" {
+		httpReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		httpReq.Header.Set("If-Modified-Since", lastModified)
+	}
+	httpRes, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch online configuration: %w", err)
+	}
+	return httpRes, nil
+}
+
+// cacheControlInterval derives the next refresh interval from the response's Cache-Control
+// max-age or, failing that, its Expires header, falling back to the poller's configured interval
+// when neither is present or parseable.
+func cacheControlInterval(header http.Header, fallback time.Duration) time.Duration {
+	if cacheControl := header.Get("Cache-Control"); cacheControl != "" {
+		for _, directive := range strings.Split(cacheControl, ",") {
+			directive = strings.TrimSpace(directive)
+			if maxAge, ok := strings.CutPrefix(directive, "max-age="); ok {
+				if seconds, err := strconv.Atoi(maxAge); err == nil && seconds >= 0 {
+					return time.Duration(seconds) * time.Second
+				}
+			}
+		}
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			if wait := time.Until(t); wait > 0 {
+				return wait
+			}
+		}
+	}
+	return fallback
+}
+
+// jitter returns d adjusted by up to ±25%, so that many pollers backing off at once don't all
+// retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	delta := time.Duration(rand.Int63n(int64(d)/2)) - d/4
+	return d + delta
+}
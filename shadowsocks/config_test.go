@@ -17,18 +17,30 @@ package shadowsocks
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/ocsp"
+	sslmatepkcs12 "software.sslmate.com/src/go-pkcs12"
 )
 
 const (
@@ -81,19 +93,16 @@ var proxies = []ProxyConfig{
 }
 
 func TestFetchConfig(t *testing.T) {
-	serverAddr := "127.0.0.1:9999"
 	cert, err := makeTLSCertificate()
 	if err != nil {
 		t.Fatalf("Failed to generate TLS certificate: %v", err)
 	}
 	certFingerprint := computeCertificateFingerprint(cert.Certificate[0])
-	server := makeOnlineConfigServer(serverAddr, cert)
-	go server.ListenAndServeTLS("", "")
+	server, serverAddr := startOnlineConfigServer(t, cert)
 	defer server.Close()
 
 	t.Run("Success", func(t *testing.T) {
-		req := FetchConfigRequest{
-			fmt.Sprintf("https://%s/200", serverAddr), "GET", certFingerprint}
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", serverAddr), Method: "GET", CertFingerprint: certFingerprint, RevocationMode: ""}
 		res, err := FetchConfig(req)
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
@@ -110,8 +119,7 @@ func TestFetchConfig(t *testing.T) {
 	})
 
 	t.Run("NotFound", func(t *testing.T) {
-		req := FetchConfigRequest{
-			fmt.Sprintf("https://%s/404", serverAddr), "GET", certFingerprint}
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/404", serverAddr), Method: "GET", CertFingerprint: certFingerprint, RevocationMode: ""}
 		res, err := FetchConfig(req)
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
@@ -128,8 +136,7 @@ func TestFetchConfig(t *testing.T) {
 	})
 
 	t.Run("Redirect", func(t *testing.T) {
-		req := FetchConfigRequest{
-			fmt.Sprintf("https://%s/301", serverAddr), "GET", certFingerprint}
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/301", serverAddr), Method: "GET", CertFingerprint: certFingerprint, RevocationMode: ""}
 		res, err := FetchConfig(req)
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
@@ -146,29 +153,762 @@ func TestFetchConfig(t *testing.T) {
 	})
 
 	t.Run("CertificateFingerprint", func(t *testing.T) {
-		req := FetchConfigRequest{
-			fmt.Sprintf("https://%s/success", serverAddr), "GET", "wrongcertfp"}
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/success", serverAddr), Method: "GET", CertFingerprint: "wrongcertfp", RevocationMode: ""}
 		_, err := FetchConfig(req)
 		if err == nil {
 			t.Fatalf("Expected TLS certificate validation error")
 		}
 	})
 
+	t.Run("SPKIFingerprint", func(t *testing.T) {
+		spkiFingerprint, err := computeSPKIFingerprint(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("Failed to compute SPKI fingerprint: %v", err)
+		}
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", serverAddr), Method: "GET", CertFingerprint: spkiFingerprint, RevocationMode: ""}
+		res, err := FetchConfig(req)
+		if err != nil {
+			t.Fatalf("Unexpected error pinning by SPKI fingerprint: %v", err)
+		}
+		if res.HTTPStatusCode != 200 {
+			t.Errorf("Expected 200 HTTP status code, got %d", res.HTTPStatusCode)
+		}
+	})
+
+	t.Run("MultiplePins", func(t *testing.T) {
+		pins := strings.Join([]string{"wrongcertfp", certFingerprint}, ",")
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", serverAddr), Method: "GET", CertFingerprint: pins, RevocationMode: ""}
+		res, err := FetchConfig(req)
+		if err != nil {
+			t.Fatalf("Unexpected error with a pin set containing the right fingerprint: %v", err)
+		}
+		if res.HTTPStatusCode != 200 {
+			t.Errorf("Expected 200 HTTP status code, got %d", res.HTTPStatusCode)
+		}
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		newCert, err := makeTLSCertificate()
+		if err != nil {
+			t.Fatalf("Failed to generate rotated TLS certificate: %v", err)
+		}
+		newServer, newServerAddr := startOnlineConfigServer(t, newCert)
+		defer newServer.Close()
+		newSPKIFingerprint, err := computeSPKIFingerprint(newCert.Certificate[0])
+		if err != nil {
+			t.Fatalf("Failed to compute rotated SPKI fingerprint: %v", err)
+		}
+
+		// The operator pre-publishes the next certificate's SPKI pin alongside the current full
+		// certificate pin, so the rotated server is trusted ahead of the switch.
+		pins := strings.Join([]string{certFingerprint, newSPKIFingerprint}, "\n")
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", newServerAddr), Method: "GET", CertFingerprint: pins, RevocationMode: ""}
+		if _, err := FetchConfig(req); err != nil {
+			t.Fatalf("Unexpected error fetching from rotated server: %v", err)
+		}
+
+		// Once rotation is complete the retired pin alone must no longer be trusted.
+		retiredReq := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", newServerAddr), Method: "GET", CertFingerprint: certFingerprint, RevocationMode: ""}
+		if _, err := FetchConfig(retiredReq); err == nil {
+			t.Fatalf("Expected retired pin to be rejected by the rotated server")
+		}
+	})
+
+	t.Run("RootCAsLayeredTrust", func(t *testing.T) {
+		ca, caKey := makeCACertificate(t)
+		leafDER, chainedCert := makeChainedTLSCertificate(t, ca, caKey, "")
+		chainedServer, chainedAddr := startOnlineConfigServer(t, chainedCert)
+		defer chainedServer.Close()
+		pin := computeCertificateFingerprint(leafDER)
+		rootCAsPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+
+		t.Run("Success", func(t *testing.T) {
+			req := FetchConfigRequest{
+				URL: fmt.Sprintf("https://%s/200", chainedAddr), Method: "GET",
+				CertFingerprint: pin, RootCAsPEM: rootCAsPEM}
+			if _, err := FetchConfig(req); err != nil {
+				t.Fatalf("Unexpected error with a pin that also chains to RootCAsPEM: %v", err)
+			}
+		})
+
+		t.Run("WrongRootCA", func(t *testing.T) {
+			otherCA, _ := makeCACertificate(t)
+			otherRootCAsPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherCA.Raw}))
+			req := FetchConfigRequest{
+				URL: fmt.Sprintf("https://%s/200", chainedAddr), Method: "GET",
+				CertFingerprint: pin, RootCAsPEM: otherRootCAsPEM}
+			if _, err := FetchConfig(req); err == nil {
+				t.Fatalf("Expected a pinned certificate that doesn't chain to RootCAsPEM to be rejected")
+			}
+		})
+	})
+
 	t.Run("NonHTTPSURL", func(t *testing.T) {
-		req := FetchConfigRequest{
-			fmt.Sprintf("http://%s/success", serverAddr), "GET", certFingerprint}
+		req := FetchConfigRequest{URL: fmt.Sprintf("http://%s/success", serverAddr), Method: "GET", CertFingerprint: certFingerprint, RevocationMode: ""}
 		_, err := FetchConfig(req)
 		if err == nil {
 			t.Fatalf("Expected error for non-HTTPs URL")
 		}
 	})
+
+	t.Run("ViaProxy", func(t *testing.T) {
+		proxy := &ProxyConfig{Password: "tunnel me", Method: "chacha20-ietf-poly1305"}
+		proxyAddr := startShadowsocksTestProxy(t, proxy, serverAddr)
+		host, portStr, err := net.SplitHostPort(proxyAddr)
+		if err != nil {
+			t.Fatalf("Failed to parse test proxy address: %v", err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			t.Fatalf("Failed to parse test proxy port: %v", err)
+		}
+		proxy.Host, proxy.Port = host, port
+
+		// Nothing listens here, simulating a network where req.URL's host is firewalled off.
+		const firewalledURL = "https://127.0.0.1:1/200"
+
+		t.Run("DirectFetchFails", func(t *testing.T) {
+			req := FetchConfigRequest{URL: firewalledURL, Method: "GET", CertFingerprint: certFingerprint}
+			if _, err := FetchConfig(req); err == nil {
+				t.Fatalf("Expected a direct fetch of the firewalled URL to fail")
+			}
+		})
+
+		t.Run("TunneledFetchSucceeds", func(t *testing.T) {
+			req := FetchConfigRequest{
+				URL: firewalledURL, Method: "GET", CertFingerprint: certFingerprint, ViaProxy: proxy}
+			res, err := FetchConfig(req)
+			if err != nil {
+				t.Fatalf("Expected the fetch to succeed via the Shadowsocks proxy, got: %v", err)
+			}
+			if res.HTTPStatusCode != 200 {
+				t.Errorf("Expected 200 HTTP status code, got %d", res.HTTPStatusCode)
+			}
+			if !reflect.DeepEqual(proxies, res.Proxies) {
+				t.Errorf("Proxy configurations don't match. Want %v, have %v", proxies, res.Proxies)
+			}
+		})
+
+		t.Run("WrongPassword", func(t *testing.T) {
+			req := FetchConfigRequest{
+				URL:             firewalledURL,
+				Method:          "GET",
+				CertFingerprint: certFingerprint,
+				ViaProxy:        &ProxyConfig{Host: proxy.Host, Port: proxy.Port, Method: proxy.Method, Password: "wrong"},
+			}
+			if _, err := FetchConfig(req); err == nil {
+				t.Fatalf("Expected a wrong proxy password to fail the tunneled fetch")
+			}
+		})
+	})
+}
+
+// startShadowsocksTestProxy starts a minimal Shadowsocks AEAD TCP proxy, accepting connections
+// encrypted per proxy's Password and Method, decrypting them, and relaying the plaintext stream
+// to forwardAddr exactly as a real Shadowsocks server would relay to the requested target. It
+// returns the proxy's listening address.
+func startShadowsocksTestProxy(t *testing.T, proxy *ProxyConfig, forwardAddr string) string {
+	t.Helper()
+	return startShadowsocksOrderedProxy(t, proxy, []string{forwardAddr})
+}
+
+// startShadowsocksOrderedProxy is startShadowsocksTestProxy generalized to more than one
+// destination: the Nth connection the proxy accepts is relayed to forwardAddrs[N], rather than
+// honoring the (possibly deliberately unreachable, in a test) address the client actually
+// requested. This lets a single proxy stand in for every destination FetchConfig dials through
+// ViaProxy in one test, including a subsequent OCSP lookup, in the order it dials them.
+func startShadowsocksOrderedProxy(t *testing.T, proxy *ProxyConfig, forwardAddrs []string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to bind test Shadowsocks proxy: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	cipherInfo, ok := ssCiphers[proxy.Method]
+	if !ok {
+		t.Fatalf("Test proxy configured with unsupported cipher method %q", proxy.Method)
+	}
+	masterKey := deriveShadowsocksKey(proxy.Password, cipherInfo.keySize)
+
+	var nextConn int32
+	go func() {
+		for {
+			rawConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			forwardAddr := forwardAddrs[int(atomic.AddInt32(&nextConn, 1)-1)%len(forwardAddrs)]
+			go serveShadowsocksTestConn(rawConn, masterKey, cipherInfo, forwardAddr)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// serveShadowsocksTestConn handles one accepted connection for startShadowsocksTestProxy: it
+// completes the AEAD handshake, discards the client's encoded target address (every test uses a
+// fixed forwardAddr instead of honoring it), and relays the plaintext stream to forwardAddr.
+func serveShadowsocksTestConn(rawConn net.Conn, masterKey []byte, cipherInfo ssCipherInfo, forwardAddr string) {
+	defer rawConn.Close()
+	conn, err := newShadowsocksConn(rawConn, masterKey, cipherInfo)
+	if err != nil {
+		return
+	}
+	addrHeader := make([]byte, 256)
+	if _, err := conn.Read(addrHeader); err != nil {
+		return
+	}
+
+	backendConn, err := net.Dial("tcp", forwardAddr)
+	if err != nil {
+		return
+	}
+	defer backendConn.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backendConn, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, backendConn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func TestFetchConfigOCSPRevocation(t *testing.T) {
+	t.Run("HardFailRevoked", func(t *testing.T) {
+		leafDER, tlsCert, ocspServer := startCAAndOCSPResponder(t, ocsp.Revoked)
+		defer ocspServer.Close()
+		configServer, addr := startOnlineConfigServer(t, tlsCert)
+		defer configServer.Close()
+
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", addr), Method: "GET", CertFingerprint: computeCertificateFingerprint(leafDER), RevocationMode: ""}
+		req.RevocationMode = RevocationHardFail
+		if _, err := FetchConfig(req); err == nil {
+			t.Fatalf("Expected a revoked certificate to be rejected under hard-fail")
+		}
+	})
+
+	t.Run("SoftFailRevoked", func(t *testing.T) {
+		leafDER, tlsCert, ocspServer := startCAAndOCSPResponder(t, ocsp.Revoked)
+		defer ocspServer.Close()
+		configServer, addr := startOnlineConfigServer(t, tlsCert)
+		defer configServer.Close()
+
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", addr), Method: "GET", CertFingerprint: computeCertificateFingerprint(leafDER), RevocationMode: ""}
+		req.RevocationMode = RevocationSoftFail
+		if _, err := FetchConfig(req); err == nil {
+			t.Fatalf("Expected a revoked certificate to be rejected even under soft-fail")
+		}
+	})
+
+	t.Run("StapledResponseTakesPriorityOverResponder", func(t *testing.T) {
+		// Nothing listens at the leaf's OCSP responder address, which soft-fail allows, but the
+		// staple says Revoked; a soft-fail policy only rejects the connection if the stapled
+		// response is the one actually consulted.
+		ca, caKey := makeCACertificate(t)
+		leafDER, tlsCert := makeChainedTLSCertificate(t, ca, caKey, "http://127.0.0.1:1/ocsp")
+		tlsCert.OCSPStaple = makeOCSPResponse(t, ca, caKey, leafDER, ocsp.Revoked)
+		configServer, addr := startOnlineConfigServer(t, tlsCert)
+		defer configServer.Close()
+
+		req := FetchConfigRequest{
+			URL: fmt.Sprintf("https://%s/200", addr), Method: "GET",
+			CertFingerprint: computeCertificateFingerprint(leafDER), RevocationMode: RevocationSoftFail}
+		if _, err := FetchConfig(req); err == nil {
+			t.Fatalf("Expected the stapled Revoked response to be honored over the (unreachable) responder")
+		}
+	})
+
+	t.Run("ResponderUnreachable", func(t *testing.T) {
+		// Nothing listens at this address, simulating an unreachable OCSP responder.
+		ca, caKey := makeCACertificate(t)
+		leafDER, tlsCert := makeChainedTLSCertificate(t, ca, caKey, "http://127.0.0.1:1/ocsp")
+		configServer, addr := startOnlineConfigServer(t, tlsCert)
+		defer configServer.Close()
+		fingerprint := computeCertificateFingerprint(leafDER)
+
+		softReq := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", addr), Method: "GET", CertFingerprint: fingerprint, RevocationMode: ""}
+		softReq.RevocationMode = RevocationSoftFail
+		if _, err := FetchConfig(softReq); err != nil {
+			t.Errorf("Expected soft-fail to allow a certificate when the OCSP responder is "+
+				"unreachable, got: %v", err)
+		}
+
+		hardReq := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", addr), Method: "GET", CertFingerprint: fingerprint, RevocationMode: ""}
+		hardReq.RevocationMode = RevocationHardFail
+		if _, err := FetchConfig(hardReq); err == nil {
+			t.Fatalf("Expected hard-fail to reject a certificate when the OCSP responder is " +
+				"unreachable")
+		}
+	})
+
+	t.Run("ViaProxyTunnelsOCSPLookup", func(t *testing.T) {
+		// The leaf's OCSPServer is a firewalled address, unreachable directly, exactly like
+		// ResponderUnreachable above. Only the tunneled lookup, routed through the proxy to the
+		// real responder below, can possibly succeed.
+		ocspServer, ca, caKey := startOCSPResponder(t, ocsp.Good)
+		defer ocspServer.Close()
+		leafDER, tlsCert := makeChainedTLSCertificate(t, ca, caKey, "http://127.0.0.1:2/ocsp")
+		configServer, configAddr := startOnlineConfigServer(t, tlsCert)
+		defer configServer.Close()
+
+		proxy := &ProxyConfig{Password: "tunnel the ocsp lookup too", Method: "chacha20-ietf-poly1305"}
+		// The config fetch dials first, then (lacking a staple) the OCSP lookup dials second;
+		// route each, in that order, to its real destination.
+		proxyAddr := startShadowsocksOrderedProxy(t, proxy, []string{configAddr, strings.TrimPrefix(ocspServer.URL, "http://")})
+		host, portStr, err := net.SplitHostPort(proxyAddr)
+		if err != nil {
+			t.Fatalf("Failed to parse test proxy address: %v", err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			t.Fatalf("Failed to parse test proxy port: %v", err)
+		}
+		proxy.Host, proxy.Port = host, port
+
+		req := FetchConfigRequest{
+			// Firewalled: the config server is only reachable through the proxy above too.
+			URL:             "https://127.0.0.1:1/200",
+			Method:          "GET",
+			CertFingerprint: computeCertificateFingerprint(leafDER),
+			RevocationMode:  RevocationHardFail,
+			ViaProxy:        proxy,
+		}
+		if _, err := FetchConfig(req); err != nil {
+			t.Fatalf("Expected the OCSP lookup to succeed by tunneling through ViaProxy, got: %v", err)
+		}
+	})
+}
+
+// makeCACertificate generates a throwaway self-signed CA, used both to sign test leaf
+// certificates and, in the OCSP tests, to sign OCSP responses about them.
+func makeCACertificate(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	now := time.Now()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{Organization: []string{"online config test CA"}},
+		NotBefore:             now,
+		NotAfter:              now.AddDate(0, 0, 1),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+	return cert, key
+}
+
+// makeChainedTLSCertificate generates a leaf certificate for 127.0.0.1, signed by ca/caKey, whose
+// OCSPServer points at ocspURL. It returns the leaf's DER bytes and a tls.Certificate presenting
+// the full [leaf, issuer] chain.
+func makeChainedTLSCertificate(
+	t *testing.T, ca *x509.Certificate, caKey *rsa.PrivateKey, ocspURL string) ([]byte, tls.Certificate) {
+	t.Helper()
+	now := time.Now()
+
+	leafKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate leaf key: %v", err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano() + 1),
+		Subject:      pkix.Name{Organization: []string{"online config"}},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    now,
+		NotAfter:     now.AddDate(0, 0, 1),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		OCSPServer:   []string{ocspURL},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, leafKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("Failed to create leaf certificate: %v", err)
+	}
+
+	return leafDER, tls.Certificate{Certificate: [][]byte{leafDER, ca.Raw}, PrivateKey: leafKey}
+}
+
+// makeOCSPResponse builds a DER-encoded OCSP response for leafDER, signed by ca/caKey, suitable
+// for use as a tls.Certificate's OCSPStaple.
+func makeOCSPResponse(t *testing.T, ca *x509.Certificate, caKey *rsa.PrivateKey, leafDER []byte, status int) []byte {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatalf("Failed to parse leaf certificate: %v", err)
+	}
+	now := time.Now()
+	res := ocsp.Response{
+		Status:       status,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(time.Hour),
+	}
+	if status == ocsp.Revoked {
+		res.RevokedAt = now
+	}
+	respBytes, err := ocsp.CreateResponse(ca, ca, res, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create stapled OCSP response: %v", err)
+	}
+	return respBytes
+}
+
+// startCAAndOCSPResponder starts an OCSP responder that answers every request with status for
+// whatever serial number it is asked about, then generates a chained test certificate, issued by
+// the same CA, pointing at that responder. It returns the leaf's DER bytes, the resulting
+// tls.Certificate, and the responder for the caller to close.
+func startCAAndOCSPResponder(t *testing.T, status int) ([]byte, tls.Certificate, *httptest.Server) {
+	t.Helper()
+	ocspServer, ca, caKey := startOCSPResponder(t, status)
+	leafDER, tlsCert := makeChainedTLSCertificate(t, ca, caKey, ocspServer.URL)
+	return leafDER, tlsCert, ocspServer
+}
+
+// startOCSPResponder starts an OCSP responder that answers every request with status for
+// whatever serial number it is asked about, signing responses with a freshly generated CA. It
+// returns the responder, for the caller to close, and the CA that can then sign a leaf
+// certificate (and, separately, a leaf's OCSPServer need not point back at this responder's own
+// address, e.g. to test a lookup that's only reachable via a tunnel).
+func startOCSPResponder(t *testing.T, status int) (*httptest.Server, *x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	ca, caKey := makeCACertificate(t)
+
+	ocspServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ocspReq, err := ocsp.ParseRequest(reqBytes)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resNow := time.Now()
+		res := ocsp.Response{
+			Status:       status,
+			SerialNumber: ocspReq.SerialNumber,
+			ThisUpdate:   resNow,
+			NextUpdate:   resNow.Add(time.Hour),
+		}
+		if status == ocsp.Revoked {
+			res.RevokedAt = resNow
+		}
+		respBytes, err := ocsp.CreateResponse(ca, ca, res, caKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(respBytes)
+	}))
+
+	return ocspServer, ca, caKey
+}
+
+func TestFetchConfigMutualTLS(t *testing.T) {
+	serverCert, err := makeTLSCertificate()
+	if err != nil {
+		t.Fatalf("Failed to generate server TLS certificate: %v", err)
+	}
+	serverFingerprint := computeCertificateFingerprint(serverCert.Certificate[0])
+	clientCertPEM, clientKeyPEM, clientLeafDER, clientKey, clientCAs := generateClientCertificate(t)
+
+	server, addr := startOnlineConfigServerWithClientAuth(t, serverCert, clientCAs)
+	defer server.Close()
+
+	t.Run("Success", func(t *testing.T) {
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", addr), Method: "GET", CertFingerprint: serverFingerprint, RevocationMode: ""}
+		req.ClientCertPEM = string(clientCertPEM)
+		req.ClientKeyPEM = string(clientKeyPEM)
+		res, err := FetchConfig(req)
+		if err != nil {
+			t.Fatalf("Unexpected error with a valid client certificate: %v", err)
+		}
+		if res.HTTPStatusCode != 200 {
+			t.Errorf("Expected 200 HTTP status code, got %d", res.HTTPStatusCode)
+		}
+	})
+
+	t.Run("WrongClientCert", func(t *testing.T) {
+		otherCertPEM, otherKeyPEM, _, _, _ := generateClientCertificate(t)
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", addr), Method: "GET", CertFingerprint: serverFingerprint, RevocationMode: ""}
+		req.ClientCertPEM = string(otherCertPEM)
+		req.ClientKeyPEM = string(otherKeyPEM)
+		if _, err := FetchConfig(req); err == nil {
+			t.Fatalf("Expected a client certificate signed by an untrusted CA to be rejected")
+		}
+	})
+
+	t.Run("PKCS12", func(t *testing.T) {
+		const password = "p12pass"
+		pfxData, err := sslmatepkcs12.Legacy.Encode(clientKey, mustParseCertificate(t, clientLeafDER), nil, password)
+		if err != nil {
+			t.Fatalf("Failed to encode PKCS#12 client certificate: %v", err)
+		}
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", addr), Method: "GET", CertFingerprint: serverFingerprint, RevocationMode: ""}
+		req.ClientPKCS12 = base64.StdEncoding.EncodeToString(pfxData)
+		req.ClientPKCS12Password = password
+		res, err := FetchConfig(req)
+		if err != nil {
+			t.Fatalf("Unexpected error with a PKCS#12 client certificate: %v", err)
+		}
+		if res.HTTPStatusCode != 200 {
+			t.Errorf("Expected 200 HTTP status code, got %d", res.HTTPStatusCode)
+		}
+	})
 }
 
-// HTTP handler for a fake online config server.
-type onlineConfigHandler struct{}
+func TestConfigPoller(t *testing.T) {
+	t.Run("Refresh", func(t *testing.T) {
+		cert, err := makeTLSCertificate()
+		if err != nil {
+			t.Fatalf("Failed to generate TLS certificate: %v", err)
+		}
+		fingerprint := computeCertificateFingerprint(cert.Certificate[0])
+		server, addr := startOnlineConfigServer(t, cert)
+		defer server.Close()
+
+		updates := make(chan Config, 1)
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", addr), Method: "GET", CertFingerprint: fingerprint}
+		poller := NewConfigPoller(req, time.Hour, func(config Config, err error) {
+			if err != nil {
+				t.Errorf("Unexpected poller error: %v", err)
+				return
+			}
+			updates <- config
+		})
+		defer poller.Stop()
+
+		select {
+		case config := <-updates:
+			if !reflect.DeepEqual(proxies, config.Proxies) {
+				t.Errorf("Proxy configurations don't match. Want %v, have %v", proxies, config.Proxies)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for the initial refresh")
+		}
+	})
+
+	t.Run("ETagCaching", func(t *testing.T) {
+		cert, err := makeTLSCertificate()
+		if err != nil {
+			t.Fatalf("Failed to generate TLS certificate: %v", err)
+		}
+		fingerprint := computeCertificateFingerprint(cert.Certificate[0])
+
+		var requestCount int32
+		handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requestCount, 1)
+			onlineConfigHandler{etag: "\"v1\""}.ServeHTTP(w, req)
+		})
+		server, addr := startOnlineConfigServerWithHandler(t, cert, handler)
+		defer server.Close()
+
+		updates := make(chan Config, 10)
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", addr), Method: "GET", CertFingerprint: fingerprint}
+		poller := NewConfigPoller(req, 20*time.Millisecond, func(config Config, err error) {
+			if err != nil {
+				t.Errorf("Unexpected poller error: %v", err)
+				return
+			}
+			updates <- config
+		})
+		defer poller.Stop()
+
+		select {
+		case <-updates:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for the initial refresh")
+		}
+
+		// Give the poller a chance to issue further conditional requests, which the server should
+		// answer with 304 Not Modified since the ETag hasn't changed.
+		time.Sleep(200 * time.Millisecond)
+
+		select {
+		case config := <-updates:
+			t.Fatalf("Expected no further update once the ETag matched, got %v", config)
+		default:
+		}
+		if got := atomic.LoadInt32(&requestCount); got < 2 {
+			t.Fatalf("Expected at least 2 requests to the server, got %d", got)
+		}
+	})
+
+	t.Run("Redirect", func(t *testing.T) {
+		cert, err := makeTLSCertificate()
+		if err != nil {
+			t.Fatalf("Failed to generate TLS certificate: %v", err)
+		}
+		fingerprint := computeCertificateFingerprint(cert.Certificate[0])
+
+		newServer, newAddr := startOnlineConfigServer(t, cert)
+		defer newServer.Close()
+
+		redirectHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Location", fmt.Sprintf("https://%s/200", newAddr))
+			w.WriteHeader(http.StatusMovedPermanently)
+		})
+		oldServer, oldAddr := startOnlineConfigServerWithHandler(t, cert, redirectHandler)
+		defer oldServer.Close()
+
+		updates := make(chan Config, 1)
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/301", oldAddr), Method: "GET", CertFingerprint: fingerprint}
+		poller := NewConfigPoller(req, time.Hour, func(config Config, err error) {
+			if err != nil {
+				t.Errorf("Unexpected poller error: %v", err)
+				return
+			}
+			updates <- config
+		})
+		defer poller.Stop()
+
+		select {
+		case config := <-updates:
+			if !reflect.DeepEqual(proxies, config.Proxies) {
+				t.Errorf("Proxy configurations don't match after following a redirect. Want %v, have %v",
+					proxies, config.Proxies)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for the refresh to follow the redirect")
+		}
+	})
+
+	t.Run("Stop", func(t *testing.T) {
+		cert, err := makeTLSCertificate()
+		if err != nil {
+			t.Fatalf("Failed to generate TLS certificate: %v", err)
+		}
+		fingerprint := computeCertificateFingerprint(cert.Certificate[0])
+		server, addr := startOnlineConfigServer(t, cert)
+		defer server.Close()
+
+		var updateCount int32
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", addr), Method: "GET", CertFingerprint: fingerprint}
+		poller := NewConfigPoller(req, 10*time.Millisecond, func(Config, error) {
+			atomic.AddInt32(&updateCount, 1)
+		})
+
+		time.Sleep(50 * time.Millisecond)
+		poller.Stop()
+		countAtStop := atomic.LoadInt32(&updateCount)
+
+		time.Sleep(50 * time.Millisecond)
+		if got := atomic.LoadInt32(&updateCount); got != countAtStop {
+			t.Errorf("Expected no updates after Stop, count went from %d to %d", countAtStop, got)
+		}
+	})
+
+	t.Run("NoConnectionLeak", func(t *testing.T) {
+		cert, err := makeTLSCertificate()
+		if err != nil {
+			t.Fatalf("Failed to generate TLS certificate: %v", err)
+		}
+		fingerprint := computeCertificateFingerprint(cert.Certificate[0])
+		server, addr := startOnlineConfigServer(t, cert)
+		defer server.Close()
+
+		before := runtime.NumGoroutine()
+
+		req := FetchConfigRequest{URL: fmt.Sprintf("https://%s/200", addr), Method: "GET", CertFingerprint: fingerprint}
+		poller := NewConfigPoller(req, 20*time.Millisecond, func(Config, error) {})
+		time.Sleep(2 * time.Second)
+		poller.Stop()
+
+		// Give any goroutines that were about to start anyway a moment to wind down, then confirm
+		// polling didn't leave behind a goroutine (and its underlying kept-alive connection) per
+		// tick, as it did prior to ConfigPoller reusing a single http.Client across refreshes.
+		var after int
+		for i := 0; i < 10; i++ {
+			runtime.GC()
+			time.Sleep(50 * time.Millisecond)
+			after = runtime.NumGoroutine()
+			if after <= before+5 {
+				break
+			}
+		}
+		if after > before+5 {
+			t.Errorf("Expected goroutine count to return close to baseline after Stop, want <= %d, have %d", before+5, after)
+		}
+	})
+}
+
+// generateClientCertificate returns PEM-encoded client certificate and key material signed by a
+// freshly generated CA, the leaf's DER bytes and private key, and an x509.CertPool containing
+// the CA for use as a server's ClientCAs.
+func generateClientCertificate(
+	t *testing.T) (certPEM, keyPEM, leafDER []byte, key *rsa.PrivateKey, clientCAs *x509.CertPool) {
+	t.Helper()
+	ca, caKey := makeCACertificate(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate client key: %v", err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{Organization: []string{"online config client"}},
+		NotBefore:    now,
+		NotAfter:     now.AddDate(0, 0, 1),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	leafDER, err = x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatalf("Failed to create client certificate: %v", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	keyPEM = pem.EncodeToMemory(
+		&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	clientCAs = x509.NewCertPool()
+	clientCAs.AddCert(ca)
+
+	return certPEM, keyPEM, leafDER, key, clientCAs
+}
+
+// mustParseCertificate parses a DER-encoded certificate, failing the test on error.
+func mustParseCertificate(t *testing.T, der []byte) *x509.Certificate {
+	t.Helper()
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return cert
+}
+
+// HTTP handler for a fake online config server. When etag is non-empty, /200 advertises it and
+// answers 304 Not Modified to a request that echoes it back in If-None-Match.
+type onlineConfigHandler struct {
+	etag string
+}
 
 func (h onlineConfigHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.URL.Path == "/200" {
+		if h.etag != "" {
+			w.Header().Set("ETag", h.etag)
+			if req.Header.Get("If-None-Match") == h.etag {
+				h.sendResponse(w, http.StatusNotModified, nil)
+				return
+			}
+		}
 		res := sip008Response{proxies, 1}
 		data, _ := json.Marshal(res)
 		h.sendResponse(w, 200, data)
@@ -186,11 +926,16 @@ func (onlineConfigHandler) sendResponse(w http.ResponseWriter, code int, data []
 	w.Write(data)
 }
 
-// Returns a SIP008 online config HTTPs server with TLS certificate cert.
-func makeOnlineConfigServer(addr string, cert tls.Certificate) http.Server {
+// Returns a SIP008 online config HTTPs server with TLS certificate cert. When clientCAs is
+// non-nil, the server requires and verifies a client certificate signed by one of those CAs.
+func makeOnlineConfigServer(addr string, cert tls.Certificate, clientCAs *x509.CertPool) http.Server {
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{cert},
 	}
+	if clientCAs != nil {
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
 	return http.Server{
 		Addr:      addr,
 		TLSConfig: tlsConfig,
@@ -198,6 +943,46 @@ func makeOnlineConfigServer(addr string, cert tls.Certificate) http.Server {
 	}
 }
 
+// startOnlineConfigServer binds a SIP008 online config HTTPs server with TLS certificate cert to
+// an ephemeral loopback port, serves it in the background, and returns it along with its address
+// once it is ready to accept connections.
+func startOnlineConfigServer(t *testing.T, cert tls.Certificate) (*http.Server, string) {
+	t.Helper()
+	return startOnlineConfigServerWithClientAuth(t, cert, nil)
+}
+
+// startOnlineConfigServerWithClientAuth is startOnlineConfigServer, additionally requiring a
+// client certificate signed by one of clientCAs when it is non-nil.
+func startOnlineConfigServerWithClientAuth(
+	t *testing.T, cert tls.Certificate, clientCAs *x509.CertPool) (*http.Server, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to bind online config server: %v", err)
+	}
+	server := makeOnlineConfigServer(listener.Addr().String(), cert, clientCAs)
+	go server.ServeTLS(listener, "", "")
+	return &server, listener.Addr().String()
+}
+
+// startOnlineConfigServerWithHandler is like startOnlineConfigServer, but serves handler instead
+// of the default onlineConfigHandler, for tests that need to observe or vary individual requests.
+func startOnlineConfigServerWithHandler(
+	t *testing.T, cert tls.Certificate, handler http.Handler) (*http.Server, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to bind online config server: %v", err)
+	}
+	server := &http.Server{
+		Addr:      listener.Addr().String(),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		Handler:   handler,
+	}
+	go server.ServeTLS(listener, "", "")
+	return server, listener.Addr().String()
+}
+
 // Generates a self-signed TLS certificate for localhost.
 func makeTLSCertificate() (tls.Certificate, error) {
 	now := time.Now()
@@ -246,4 +1031,30 @@ func TestComputeCertificateFingerprint(t *testing.T) {
 		t.Errorf("Certificate fingerprints don't match. Want %s, got %s",
 			exampleCertFingerprint, certFingerprint)
 	}
-}
\ No newline at end of file
+}
+
+func TestComputeSPKIFingerprint(t *testing.T) {
+	pemCertData := []byte(examplePemCert)
+	block, _ := pem.Decode(pemCertData)
+	if block == nil || block.Type != "CERTIFICATE" {
+		t.Fatalf("Failed to decode certificate PEM block")
+	}
+
+	spkiFingerprint, err := computeSPKIFingerprint(block.Bytes)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(spkiFingerprint, "sha256/") {
+		t.Errorf("Expected SPKI fingerprint to use the sha256/ prefix, got %s", spkiFingerprint)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	wantSum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	want := "sha256/" + base64.StdEncoding.EncodeToString(wantSum[:])
+	if spkiFingerprint != want {
+		t.Errorf("SPKI fingerprints don't match. Want %s, got %s", want, spkiFingerprint)
+	}
+}
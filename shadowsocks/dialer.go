@@ -0,0 +1,278 @@
+// Copyright 2021 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// maxSSChunkSize is the largest payload the Shadowsocks AEAD TCP protocol allows in a single
+// encrypted chunk; length fields are 14 bits, per https://shadowsocks.org/guide/aead.html.
+const maxSSChunkSize = 0x3FFF
+
+// ssCipherInfo describes an AEAD construction supported as a ProxyConfig.Method.
+type ssCipherInfo struct {
+	keySize int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// ssCiphers maps the Shadowsocks AEAD method names this package understands to their AEAD
+// construction. Only the ciphers needed to bootstrap a fetch are implemented; a proxy configured
+// with anything else is rejected by dialShadowsocks.
+var ssCiphers = map[string]ssCipherInfo{
+	"aes-128-gcm": {16, func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}},
+	"aes-256-gcm": {32, func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}},
+	"chacha20-ietf-poly1305": {32, chacha20poly1305.New},
+}
+
+// dialShadowsocks dials proxy and returns a net.Conn that transparently encrypts writes to, and
+// decrypts reads from, targetAddr ("host:port") using the Shadowsocks AEAD TCP protocol. The
+// returned conn is ready for the caller to layer a further protocol (e.g. TLS) on top of, exactly
+// as if it had dialed targetAddr directly.
+func dialShadowsocks(ctx context.Context, proxy *ProxyConfig, targetAddr string) (net.Conn, error) {
+	cipherInfo, ok := ssCiphers[proxy.Method]
+	if !ok {
+		return nil, fmt.Errorf("unsupported Shadowsocks cipher method %q", proxy.Method)
+	}
+	targetHeader, err := shadowsocksAddrHeader(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	rawConn, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(proxy.Host, strconv.Itoa(proxy.Port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial Shadowsocks proxy: %w", err)
+	}
+
+	masterKey := deriveShadowsocksKey(proxy.Password, cipherInfo.keySize)
+	conn, err := newShadowsocksConn(rawConn, masterKey, cipherInfo)
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	if _, err := conn.Write(targetHeader); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send Shadowsocks target address: %w", err)
+	}
+	return conn, nil
+}
+
+// deriveShadowsocksKey derives a keySize-byte master key from password using EVP_BytesToKey, the
+// OpenSSL-compatible KDF Shadowsocks uses to turn a user-supplied password into key material.
+func deriveShadowsocksKey(password string, keySize int) []byte {
+	var key []byte
+	var prev []byte
+	for len(key) < keySize {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keySize]
+}
+
+// shadowsocksAddrHeader encodes addr ("host:port") as a Shadowsocks/SOCKS5-style address, the
+// first thing sent over a new Shadowsocks stream to tell the proxy where to connect.
+func shadowsocksAddrHeader(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target address %q: %w", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid target port %q", portStr)
+	}
+
+	var header []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			header = append([]byte{0x01}, ip4...)
+		} else {
+			header = append([]byte{0x04}, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("target hostname %q is too long", host)
+		}
+		header = append([]byte{0x03, byte(len(host))}, []byte(host)...)
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	return append(header, portBytes...), nil
+}
+
+// ssConn wraps a raw Shadowsocks TCP connection, encrypting Write calls and decrypting Read calls
+// per the AEAD protocol: a per-direction random salt, from which an HKDF-SHA1 subkey is derived,
+// followed by a stream of [encrypted 2-byte length | encrypted payload] chunks, each individually
+// authenticated and using an incrementing nonce.
+type ssConn struct {
+	net.Conn
+	masterKey  []byte
+	cipherInfo ssCipherInfo
+
+	writeAEAD  cipher.AEAD
+	writeNonce []byte
+
+	readAEAD  cipher.AEAD
+	readNonce []byte
+	readBuf   []byte
+}
+
+// newShadowsocksConn generates this connection's request salt, writes it (unencrypted, as the
+// protocol requires) to rawConn, and derives the AEAD used to encrypt subsequent writes. The AEAD
+// used to decrypt reads is derived lazily, on the first Read, from the response salt the proxy
+// sends back.
+func newShadowsocksConn(rawConn net.Conn, masterKey []byte, cipherInfo ssCipherInfo) (*ssConn, error) {
+	salt := make([]byte, cipherInfo.keySize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate Shadowsocks salt: %w", err)
+	}
+	writeAEAD, err := deriveShadowsocksAEAD(masterKey, salt, cipherInfo)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rawConn.Write(salt); err != nil {
+		return nil, fmt.Errorf("failed to send Shadowsocks salt: %w", err)
+	}
+	return &ssConn{
+		Conn:       rawConn,
+		masterKey:  masterKey,
+		cipherInfo: cipherInfo,
+		writeAEAD:  writeAEAD,
+		writeNonce: make([]byte, writeAEAD.NonceSize()),
+	}, nil
+}
+
+// deriveShadowsocksAEAD derives the AEAD for one direction of the stream from masterKey and that
+// direction's salt, per the "ss-subkey" HKDF-SHA1 construction in the Shadowsocks AEAD spec.
+func deriveShadowsocksAEAD(masterKey, salt []byte, cipherInfo ssCipherInfo) (cipher.AEAD, error) {
+	subkey := make([]byte, cipherInfo.keySize)
+	if _, err := io.ReadFull(hkdf.New(sha1.New, masterKey, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, fmt.Errorf("failed to derive Shadowsocks subkey: %w", err)
+	}
+	return cipherInfo.newAEAD(subkey)
+}
+
+// incrementNonce advances nonce by one, as required after every AEAD seal/open on a Shadowsocks
+// stream, treating it as a little-endian counter.
+func incrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *ssConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxSSChunkSize {
+			chunk = chunk[:maxSSChunkSize]
+		}
+
+		var lengthBytes [2]byte
+		binary.BigEndian.PutUint16(lengthBytes[:], uint16(len(chunk)))
+		sealedLength := c.writeAEAD.Seal(nil, c.writeNonce, lengthBytes[:], nil)
+		incrementNonce(c.writeNonce)
+		sealedPayload := c.writeAEAD.Seal(nil, c.writeNonce, chunk, nil)
+		incrementNonce(c.writeNonce)
+
+		if _, err := c.Conn.Write(append(sealedLength, sealedPayload...)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *ssConn) Read(b []byte) (int, error) {
+	if len(c.readBuf) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// readChunk reads and decrypts the next chunk off the wire into c.readBuf, first deriving the
+// read-direction AEAD from the response salt if this is the first read.
+func (c *ssConn) readChunk() error {
+	if c.readAEAD == nil {
+		salt := make([]byte, c.cipherInfo.keySize)
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return fmt.Errorf("failed to read Shadowsocks response salt: %w", err)
+		}
+		readAEAD, err := deriveShadowsocksAEAD(c.masterKey, salt, c.cipherInfo)
+		if err != nil {
+			return err
+		}
+		c.readAEAD = readAEAD
+		c.readNonce = make([]byte, readAEAD.NonceSize())
+	}
+
+	sealedLength := make([]byte, 2+c.readAEAD.Overhead())
+	if _, err := io.ReadFull(c.Conn, sealedLength); err != nil {
+		return fmt.Errorf("failed to read Shadowsocks chunk length: %w", err)
+	}
+	lengthBytes, err := c.readAEAD.Open(nil, c.readNonce, sealedLength, nil)
+	if err != nil {
+		return fmt.Errorf("failed to authenticate Shadowsocks chunk length: %w", err)
+	}
+	incrementNonce(c.readNonce)
+	length := binary.BigEndian.Uint16(lengthBytes) & maxSSChunkSize
+
+	sealedPayload := make([]byte, int(length)+c.readAEAD.Overhead())
+	if _, err := io.ReadFull(c.Conn, sealedPayload); err != nil {
+		return fmt.Errorf("failed to read Shadowsocks chunk payload: %w", err)
+	}
+	payload, err := c.readAEAD.Open(nil, c.readNonce, sealedPayload, nil)
+	if err != nil {
+		return fmt.Errorf("failed to authenticate Shadowsocks chunk payload: %w", err)
+	}
+	incrementNonce(c.readNonce)
+	c.readBuf = payload
+	return nil
+}